@@ -0,0 +1,108 @@
+package grace
+
+import (
+	"net"
+	"testing"
+)
+
+func listenTCP(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln
+}
+
+// TestTakeoverMatchesByAddressOrder验证GRACE_LISTEN_ORDER按地址而不是位置
+// 下标匹配继承的fd：子进程调用Takeover的顺序和父进程注册监听句柄的顺序
+// 不一致时，每个Takeover调用仍然应该拿到地址匹配的那一个继承句柄。
+func TestTakeoverMatchesByAddressOrder(t *testing.T) {
+	lnA := listenTCP(t)
+	lnB := listenTCP(t)
+
+	n := &Net{}
+	n.inheritOnce.Do(func() {})
+	n.inherited = []net.Listener{lnA, lnB}
+	n.listenOrder = []string{addrKey(lnA.Addr()), addrKey(lnB.Addr())}
+
+	// 故意按与listenOrder相反的顺序调用Takeover
+	gotB, err := n.Takeover(lnB)
+	if err != nil {
+		t.Fatalf("Takeover(lnB): %v", err)
+	}
+	if *gotB != net.Listener(lnB) {
+		t.Fatalf("Takeover(lnB) = %v, want the inherited listener bound to lnB's address", *gotB)
+	}
+
+	gotA, err := n.Takeover(lnA)
+	if err != nil {
+		t.Fatalf("Takeover(lnA): %v", err)
+	}
+	if *gotA != net.Listener(lnA) {
+		t.Fatalf("Takeover(lnA) = %v, want the inherited listener bound to lnA's address", *gotA)
+	}
+}
+
+// TestTakeoverMatchesByFdPosition验证"fd@N"形式的GRACE_LISTEN_ORDER项：
+// 当继承的句柄地址在子进程侧无法比较时，按第N次Takeover调用的顺序接管，
+// 而不是按地址字符串匹配。
+func TestTakeoverMatchesByFdPosition(t *testing.T) {
+	lnA := listenTCP(t)
+	lnB := listenTCP(t)
+
+	n := &Net{}
+	n.inheritOnce.Do(func() {})
+	n.inherited = []net.Listener{lnA, lnB}
+	n.listenOrder = []string{"fd@0", "fd@1"}
+
+	// fd@N不看Takeover传入的listener地址，只看调用顺序
+	unrelated := listenTCP(t)
+
+	got1, err := n.Takeover(unrelated)
+	if err != nil {
+		t.Fatalf("first Takeover: %v", err)
+	}
+	if *got1 != net.Listener(lnA) {
+		t.Fatalf("first Takeover (seq 0) = %v, want fd@0's listener (lnA)", *got1)
+	}
+
+	got2, err := n.Takeover(unrelated)
+	if err != nil {
+		t.Fatalf("second Takeover: %v", err)
+	}
+	if *got2 != net.Listener(lnB) {
+		t.Fatalf("second Takeover (seq 1) = %v, want fd@1's listener (lnB)", *got2)
+	}
+}
+
+// TestTakeoverNamedMatchesByFdName验证TakeoverNamed按LISTEN_FDNAMES提供的
+// 名称接管继承句柄，适用于socket-activation场景下地址本身无法比较的情况。
+func TestTakeoverNamedMatchesByFdName(t *testing.T) {
+	lnA := listenTCP(t)
+	lnB := listenTCP(t)
+
+	n := &Net{}
+	n.inheritOnce.Do(func() {})
+	n.inherited = []net.Listener{lnA, lnB}
+	n.fdNames = []string{"web", "admin"}
+
+	got, err := n.TakeoverNamed("admin", listenTCP(t))
+	if err != nil {
+		t.Fatalf("TakeoverNamed: %v", err)
+	}
+	if *got != net.Listener(lnB) {
+		t.Fatalf("TakeoverNamed(\"admin\") = %v, want the listener named \"admin\" (lnB)", *got)
+	}
+
+	// 名字不存在时退化为使用调用方传入的新listener
+	fresh := listenTCP(t)
+	got, err = n.TakeoverNamed("missing", fresh)
+	if err != nil {
+		t.Fatalf("TakeoverNamed(missing): %v", err)
+	}
+	if *got != net.Listener(fresh) {
+		t.Fatalf("TakeoverNamed(\"missing\") should fall back to the freshly created listener")
+	}
+}
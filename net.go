@@ -1,18 +1,32 @@
 package grace
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
 	LISTEN_FD_NUM = "LISTEN_FDS"
+	// GRACE_READY_FD 子进程用来通知父进程"已就绪"的管道fd编号
+	GRACE_READY_FD = "GRACE_READY_FD"
+	// GRACE_LISTEN_ORDER 描述继承的fd与监听地址的对应关系，由StartProcess写入，
+	// inherit()读取。取值形如"tcp://:8080,unix:///var/run/x.sock,tcp://:8443"，
+	// 按fd 3,4,5...的顺序一一对应。某一项也可以写成"fd@N"，表示不关心地址，
+	// 这一项对应的fd交给第N次Takeover调用(从0开始计数)接管，用于Takeover调用顺序与父进程不一致的场景。
+	GRACE_LISTEN_ORDER = "GRACE_LISTEN_ORDER"
+	// LISTEN_FDNAMES 是systemd socket-activation约定的fd命名环境变量，取值为用
+	// 冒号分隔的名称列表，与fd 3,4,5...按顺序一一对应，配合TakeoverNamed使用。
+	LISTEN_FDNAMES = "LISTEN_FDNAMES"
 )
 
 //type Application interface {
@@ -24,6 +38,47 @@ type filer interface {
 	File() (*os.File, error)
 }
 
+// unwrapTCPListener 尝试从一个net.Listener中解出内部真正的*net.TCPListener。
+// *tls.Listener之类的包装类型并没有对外暴露File()方法，这里借助反射"掀开"
+// 这层包装，找到可以取出fd的TCPListener，使Takeover/StartProcess也能接管
+// TLS监听句柄。*tls.Listener内部是匿名嵌入的net.Listener字段，字段名正是
+// "Listener"，匿名嵌入让这个字段本身是导出的，因此直接用FieldByName+
+// Interface()就能取到值，不需要unsafe绕过可见性限制。
+func unwrapTCPListener(l net.Listener) (*net.TCPListener, bool) {
+	for {
+		if tcp, ok := l.(*net.TCPListener); ok {
+			return tcp, true
+		}
+
+		v := reflect.ValueOf(l)
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return nil, false
+		}
+		field := v.Elem().FieldByName("Listener")
+		if !field.IsValid() || field.Kind() != reflect.Interface {
+			return nil, false
+		}
+		inner, ok := field.Interface().(net.Listener)
+		if !ok || inner == nil {
+			return nil, false
+		}
+		l = inner
+	}
+}
+
+// fileOf 获取listener对应的*os.File，用于fork子进程时继承fd。
+// 优先使用listener自身实现的filer接口(*net.TCPListener/*net.UnixListener)，
+// 如果是*tls.Listener这类包装类型，则解包后取内部TCPListener的File()。
+func fileOf(l net.Listener) (*os.File, error) {
+	if f, ok := l.(filer); ok {
+		return f.File()
+	}
+	if tcp, ok := unwrapTCPListener(l); ok {
+		return tcp.File()
+	}
+	return nil, fmt.Errorf("grace: listener %T does not support File()", l)
+}
+
 // 比较两个地址是否相等
 func compare(na1, na2 net.Addr) bool {
 	// 网络类型不同直接返回false, 例如tcp与udp
@@ -31,13 +86,31 @@ func compare(na1, na2 net.Addr) bool {
 		return false
 	}
 
-	// 去除IPv4和IPv6前缀然后做比较
+	return trimWildcard(na1.String()) == trimWildcard(na2.String())
+}
+
+// 去除IPv4和IPv6通配前缀
+func trimWildcard(addr string) string {
 	const IPV4_PREFIX = "0.0.0.0"
 	const IPV6_PREFIX = "[::]"
-	na1s := strings.TrimPrefix(strings.TrimPrefix(na1.String(), IPV6_PREFIX), IPV4_PREFIX)
-	na2s := strings.TrimPrefix(strings.TrimPrefix(na2.String(), IPV6_PREFIX), IPV4_PREFIX)
+	return strings.TrimPrefix(strings.TrimPrefix(addr, IPV6_PREFIX), IPV4_PREFIX)
+}
+
+// addrKey 把一个net.Addr格式化成GRACE_LISTEN_ORDER里使用的"network://address"形式
+func addrKey(a net.Addr) string {
+	return a.Network() + "://" + trimWildcard(a.String())
+}
 
-	return na1s == na2s
+// fdPosition 解析"fd@N"形式的GRACE_LISTEN_ORDER项，返回N
+func fdPosition(key string) (int, bool) {
+	if !strings.HasPrefix(key, "fd@") {
+		return 0, false
+	}
+	pos, err := strconv.Atoi(strings.TrimPrefix(key, "fd@"))
+	if err != nil {
+		return 0, false
+	}
+	return pos, true
 }
 
 // 获取绝对路径
@@ -56,12 +129,32 @@ func which(cmd string) (string, error) {
 type Net struct {
 	// 从父进程继承的监听句柄
 	inherited []net.Listener
+	// 与inherited一一对应的GRACE_LISTEN_ORDER描述("tcp://:8080"/"fd@N")，
+	// 未设置GRACE_LISTEN_ORDER时为空
+	listenOrder []string
+	// 与inherited一一对应的LISTEN_FDNAMES名称，未设置时为空
+	fdNames []string
 	// 互斥锁
 	mutex sync.Mutex
 	// 确保只从父进程继承一次监听句柄
 	inheritOnce sync.Once
 	// 当前进程活跃的监听句柄
 	active []net.Listener
+	// Takeover/TakeoverTLS被调用的次数(TakeoverNamed不计入)，用于匹配"fd@N"形式的顺序描述
+	takeoverSeq int
+
+	// PIDFile是记录当前持有监听句柄的进程pid的文件路径，为空表示不使用
+	// pid文件(也就不做双重fork检测)
+	PIDFile string
+	// pidLock是PIDFile上的flock劝告锁，持有期间表示"我是当前这一代进程"
+	pidLock *os.File
+	// forking标记是否已经有一次StartProcess在等待对应的Supervise完成，
+	// 用来拒绝短时间内的第二次fork，避免出现多个子进程绑定同一组fd
+	forking int32
+	// pendingReady/pendingPID是上一次StartProcess返回之后、等待Supervise
+	// 消费的就绪管道与子进程pid
+	pendingReady *os.File
+	pendingPID   int
 }
 
 func (n *Net) inherit() (retErr error) {
@@ -77,6 +170,12 @@ func (n *Net) inherit() (retErr error) {
 		if err != nil {
 			retErr = fmt.Errorf("found invalid count value: %s=%s", LISTEN_FD_NUM, ldNumStr)
 		}
+		if order := os.Getenv(GRACE_LISTEN_ORDER); order != "" {
+			n.listenOrder = strings.Split(order, ",")
+		}
+		if names := os.Getenv(LISTEN_FDNAMES); names != "" {
+			n.fdNames = strings.Split(names, ":")
+		}
 		// 0-2 分别被os.Stdin os.Stdout os.Stderr占用
 		for i := 3; i < 3+ldNum; i++ {
 			file := os.NewFile(uintptr(i), "listener")
@@ -104,8 +203,27 @@ func (n *Net) activeListener() ([]net.Listener, error) {
 	return listeners, nil
 }
 
-// 接管监听句柄
+// 接管监听句柄。如果l是*tls.Listener(或其他TLS包装)，请改用TakeoverTLS——
+// *tls.Listener是crypto/tls包内部的非导出类型，既没有暴露取回*tls.Config的
+// 方法，也无法从外部反射出它的非导出字段(chunk0-1已经把unwrapTCPListener里的
+// unsafe去掉了，这里同样不能绕过可见性)，所以Takeover自己没有办法在继承场景
+// 下知道要不要、以及用哪份配置重新包一层TLS：继承来的listener永远是
+// inherit()里net.FileListener吐出来的裸TCP句柄。不用TakeoverTLS的后果是，
+// 首次启动时l本身是TLS的，拿到的是TLS监听句柄，但每次重启之后拿到的都是裸
+// TCP句柄——服务会在不知不觉间把本该加密的端口改成明文。
 func (n *Net) Takeover(l net.Listener) (*net.Listener, error) {
+	return n.takeover(l, nil)
+}
+
+// TakeoverTLS接管一个TLS监听句柄，l应当是tls.NewListener(tcpLn, config)的
+// 返回值，config则是构造l时使用的同一份*tls.Config。继承自旧进程的句柄只是
+// 裸TCP fd，TakeoverTLS会在返回前用config把它重新包装成tls.Listener，确保
+// 重启前后调用方看到的始终是同一种类型、同一份证书配置的监听句柄。
+func (n *Net) TakeoverTLS(l net.Listener, config *tls.Config) (*net.Listener, error) {
+	return n.takeover(l, config)
+}
+
+func (n *Net) takeover(l net.Listener, tlsConfig *tls.Config) (*net.Listener, error) {
 	if err := n.inherit(); err != nil {
 		return nil, err
 	}
@@ -113,53 +231,304 @@ func (n *Net) Takeover(l net.Listener) (*net.Listener, error) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
-	//如果与从旧进程继承的监听句柄相同，则沿用继承来的监听句柄
-	for i, listener := range n.inherited {
-		if listener == nil {
-			continue
+	if listener := n.takeInheritedLocked(l.Addr()); listener != nil {
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
 		}
-		if compare(l.Addr(), listener.Addr()) {
-			n.inherited[i] = nil
-			n.active = append(n.active, listener)
-			return &listener, nil
+		n.active = append(n.active, listener)
+		return &listener, nil
+	}
+
+	n.active = append(n.active, l)
+	return &l, nil
+}
+
+// TakeoverNamed 按LISTEN_FDNAMES(或einhorn等socket-activation管理器提供的等价命名)
+// 接管监听句柄，适用于调用方在启动时无法提前知道监听地址、只知道socket名称的场景。
+func (n *Net) TakeoverNamed(name string, l net.Listener) (*net.Listener, error) {
+	if err := n.inherit(); err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for i, fdName := range n.fdNames {
+		if i >= len(n.inherited) || n.inherited[i] == nil || fdName != name {
+			continue
 		}
+		listener := n.inherited[i]
+		n.inherited[i] = nil
+		n.active = append(n.active, listener)
+		return &listener, nil
 	}
 
 	n.active = append(n.active, l)
 	return &l, nil
 }
 
+// takeInheritedLocked 在持有mutex的前提下，按GRACE_LISTEN_ORDER(地址或"fd@N"顺序)
+// 查找与addr对应的继承句柄；如果父进程没有设置GRACE_LISTEN_ORDER，则退化为按地址
+// 比较的方式(兼容旧行为)。调用方需要持有n.mutex。
+func (n *Net) takeInheritedLocked(addr net.Addr) net.Listener {
+	seq := n.takeoverSeq
+	n.takeoverSeq++
+
+	if len(n.listenOrder) != len(n.inherited) {
+		// 没有可靠的顺序信息，退化为按地址比较
+		for i, listener := range n.inherited {
+			if listener == nil {
+				continue
+			}
+			if compare(addr, listener.Addr()) {
+				n.inherited[i] = nil
+				return listener
+			}
+		}
+		return nil
+	}
+
+	key := addrKey(addr)
+	for i, entry := range n.listenOrder {
+		if n.inherited[i] == nil {
+			continue
+		}
+		// "fd@N"表示这一项不按地址匹配，而是按第N次Takeover调用的顺序匹配，
+		// 用于子进程调用Takeover的顺序与父进程注册顺序不一致，或该句柄的
+		// 地址在子进程侧无法比较(例如socket-activation传入的句柄)的场景
+		if pos, ok := fdPosition(entry); ok {
+			if pos != seq {
+				continue
+			}
+		} else if entry != key {
+			continue
+		}
+		listener := n.inherited[i]
+		n.inherited[i] = nil
+		return listener
+	}
+	return nil
+}
+
+// StartProcess fork一个新的子进程，并将当前进程持有的监听句柄继承给它。
+// 如果上一次StartProcess启动的子进程还没有被Supervise确认就绪，
+// StartProcess会直接拒绝，避免两次SIGHUP在短时间内各自fork出一个子进程，
+// 都绑定在同一组继承fd上造成脑裂。
+//
+// 配置了PIDFile时，StartProcess还会在真正fork之前抢占式地获取PIDFile上的
+// flock劝告锁：如果这把锁已经被另一个进程持有(例如一次异常的双重fork，或者
+// 上一代进程的Drain因为某种原因没有跑到)，StartProcess会直接失败、不fork出
+// 子进程，而不是像fork完成后才发现锁拿不到——那样子进程可能早已经
+// NotifyReady并开始在共享的继承fd上accept，脑裂已经发生，为时已晚。
+//
+// StartProcess本身不等待子进程就绪、也不会关闭当前进程的监听句柄，调用方
+// 必须随后调用Supervise完成这次重启(确认子进程就绪、写pid文件、Drain旧句柄)。
 func (n *Net) StartProcess() (int, error) {
-	listeners, err := n.activeListener()
+	if !atomic.CompareAndSwapInt32(&n.forking, 0, 1) {
+		return 0, fmt.Errorf("grace: a fork is already in progress, call Supervise first")
+	}
+
+	if err := n.acquirePIDLock(); err != nil {
+		atomic.StoreInt32(&n.forking, 0)
+		return 0, err
+	}
+
+	pid, readyFile, err := n.startProcess()
+	if err != nil {
+		atomic.StoreInt32(&n.forking, 0)
+		return 0, err
+	}
+
+	n.mutex.Lock()
+	n.pendingReady, n.pendingPID = readyFile, pid
+	n.mutex.Unlock()
+
+	return pid, nil
+}
+
+// StartProcessAndWait是StartProcess+Supervise的组合便利方法，适用于调用方
+// 不需要把fork和"等待就绪后关闭旧句柄"分成两步的场景。
+func (n *Net) StartProcessAndWait(readyTimeout time.Duration) (int, error) {
+	pid, err := n.StartProcess()
 	if err != nil {
 		return 0, err
 	}
+	return pid, n.Supervise(readyTimeout)
+}
+
+// Supervise等待上一次StartProcess启动的子进程通过NotifyReady发出就绪信号，
+// 确认它已经成功inherit()之后才把它的pid写入PIDFile(如果配置了)，然后对
+// 当前进程持有的监听句柄执行优雅关闭(Drain)，从而实现重启过程中不丢连接。
+//
+// 如果在readyTimeout内没有收到就绪信号，则返回超时错误，旧监听句柄保持不变；
+// 无论成功与否，Supervise都会释放StartProcess加上的fork守卫，使下一次
+// StartProcess可以正常发起。
+func (n *Net) Supervise(readyTimeout time.Duration) error {
+	defer atomic.StoreInt32(&n.forking, 0)
+
+	n.mutex.Lock()
+	readyFile, pid := n.pendingReady, n.pendingPID
+	n.pendingReady, n.pendingPID = nil, 0
+	n.mutex.Unlock()
+
+	if readyFile == nil {
+		return fmt.Errorf("grace: Supervise called without a pending StartProcess")
+	}
+	defer readyFile.Close()
+
+	if err := readyFile.SetReadDeadline(time.Now().Add(readyTimeout)); err != nil {
+		return err
+	}
+	if _, err := readyFile.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("grace: timed out waiting for child %d to become ready: %s", pid, err)
+	}
+
+	if err := n.writePIDFile(pid); err != nil {
+		return err
+	}
+	return n.Drain()
+}
+
+// acquirePIDLock确保当前进程持有PIDFile上的flock劝告锁，必须在startProcess()
+// 真正fork子进程之前调用：锁拿不到就意味着已经有另一个进程自认为是"当前这
+// 一代"，这时必须直接拒绝这次重启，而不是fork完、子进程都就绪了才发现锁的
+// 归属有问题——那时候旧的enforcement时机已经挽救不了脑裂。PIDFile为空或锁
+// 已经持有时直接返回nil。
+func (n *Net) acquirePIDLock() error {
+	if n.PIDFile == "" {
+		return nil
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.pidLock != nil {
+		return nil
+	}
+	lock, err := acquirePIDFileLock(n.PIDFile)
+	if err != nil {
+		return fmt.Errorf("grace: another process already owns %s: %s", n.PIDFile, err)
+	}
+	n.pidLock = lock
+	return nil
+}
+
+// writePIDFile把pid写入PIDFile。正常情况下锁已经由StartProcess调用的
+// acquirePIDLock在fork之前拿到，这里只是兜底再确认一次，真正的工作是
+// truncate+写入当前pid。PIDFile为空时什么也不做。
+func (n *Net) writePIDFile(pid int) error {
+	if n.PIDFile == "" {
+		return nil
+	}
+	if err := n.acquirePIDLock(); err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if err := n.pidLock.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := n.pidLock.WriteAt([]byte(strconv.Itoa(pid)), 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+// NotifyReady 由新启动的子进程调用，通知父进程自己已经完成inherit()并可以对外提供服务。
+// 如果当前进程不是由StartProcess启动的(环境变量未设置)，则什么也不做。
+func (n *Net) NotifyReady() error {
+	fdStr := os.Getenv(GRACE_READY_FD)
+	if fdStr == "" {
+		return nil
+	}
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return fmt.Errorf("grace: found invalid fd value: %s=%s", GRACE_READY_FD, fdStr)
+	}
+	file := os.NewFile(uintptr(fd), "ready")
+	defer file.Close()
+	_, err = file.Write([]byte{1})
+	return err
+}
+
+// Drain 优雅关闭当前进程持有的监听句柄，不再接受新连接。
+// 已经建立的连接由各自的处理逻辑自行决定何时结束，Drain只负责停止accept。
+func (n *Net) Drain() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var firstErr error
+	for _, listener := range n.active {
+		if err := listener.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	n.active = nil
+
+	// 本进程不再持有监听句柄，释放pidfile锁，让接管成功的子进程在它自己
+	// 发起下一次重启、StartProcess调用acquirePIDLock时能够拿到这把锁
+	if n.pidLock != nil {
+		n.pidLock.Close()
+		n.pidLock = nil
+	}
+	return firstErr
+}
+
+func (n *Net) startProcess() (int, *os.File, error) {
+	listeners, err := n.activeListener()
+	if err != nil {
+		return 0, nil, err
+	}
 
 	files := make([]*os.File, len(listeners))
 	for i, listener := range listeners {
-		if files[i], err = listener.(filer).File(); err != nil {
-			return 0, err
+		if files[i], err = fileOf(listener); err != nil {
+			return 0, nil, err
 		}
 		defer files[i].Close()
 	}
 
 	cmd, err := which(os.Args[0])
 	if err != nil {
-		return 0, err
+		return 0, nil, err
 	}
 
 	// 新进程继承旧进程环境变量
 	var env []string
 	for _, kv := range os.Environ() {
-		// 排除监听句柄数
-		if !strings.HasPrefix(kv, fmt.Sprintf("%s=", LISTEN_FD_NUM)) {
+		// 排除监听句柄数、上一次的就绪fd以及上一次的监听顺序描述
+		if !strings.HasPrefix(kv, fmt.Sprintf("%s=", LISTEN_FD_NUM)) &&
+			!strings.HasPrefix(kv, fmt.Sprintf("%s=", GRACE_READY_FD)) &&
+			!strings.HasPrefix(kv, fmt.Sprintf("%s=", GRACE_LISTEN_ORDER)) {
 			env = append(env, kv)
 		}
 	}
 	env = append(env, fmt.Sprintf("%s=%d", LISTEN_FD_NUM, len(listeners)))
 
-	// 继承文件句柄
+	// 按fd 3,4,5...的顺序记录每个监听句柄的地址，子进程据此按地址而非
+	// 位置下标来查找应该接管哪个继承的fd
+	if len(listeners) > 0 {
+		order := make([]string, len(listeners))
+		for i, listener := range listeners {
+			order[i] = addrKey(listener.Addr())
+		}
+		env = append(env, fmt.Sprintf("%s=%s", GRACE_LISTEN_ORDER, strings.Join(order, ",")))
+	}
+
 	allFiles := append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...)
+
+	// 额外传递一个管道fd给子进程，子进程就绪后通过它写入一个字节通知父进程，
+	// 父进程在Supervise里读取这个信号
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer readyWriter.Close()
+	readyFD := len(allFiles)
+	allFiles = append(allFiles, readyWriter)
+	env = append(env, fmt.Sprintf("%s=%d", GRACE_READY_FD, readyFD))
+
 	originalWD, _ := os.Getwd()
 	process, err := os.StartProcess(cmd, os.Args, &os.ProcAttr{
 		Files: allFiles,
@@ -167,7 +536,8 @@ func (n *Net) StartProcess() (int, error) {
 		Dir:   originalWD,
 	})
 	if err != nil {
-		return 0, err
+		readyReader.Close()
+		return 0, nil, err
 	}
-	return process.Pid, nil
+	return process.Pid, readyReader, nil
 }
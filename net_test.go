@@ -0,0 +1,67 @@
+package grace
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+// withSimulatedInheritance让一个全新的Net看起来像是已经从父进程继承了listener，
+// 而不必真的摆弄LISTEN_FDS/fd 3..N——直接把inheritOnce标记为"已经做过"，
+// 并填入测试用的inherited/listenOrder，效果与真正走过一次inherit()等价。
+func withSimulatedInheritance(t *testing.T, listener net.Listener) *Net {
+	t.Helper()
+	n := &Net{}
+	n.inheritOnce.Do(func() {})
+	n.inherited = []net.Listener{listener}
+	n.listenOrder = []string{addrKey(listener.Addr())}
+	return n
+}
+
+// TestTakeoverTLSPreservesConfigAcrossInheritance验证重启后再次调用
+// TakeoverTLS拿到的仍然是一个tls.Listener，而不是inherit()吐出来的裸TCP
+// 句柄——否则服务会在不知不觉间从加密降级成明文。
+func TestTakeoverTLSPreservesConfigAcrossInheritance(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer raw.Close()
+
+	cfg := &tls.Config{ServerName: "example.test"}
+	tlsLn := tls.NewListener(raw, cfg)
+
+	n := withSimulatedInheritance(t, raw)
+
+	got, err := n.TakeoverTLS(tlsLn, cfg)
+	if err != nil {
+		t.Fatalf("TakeoverTLS: %v", err)
+	}
+
+	if _, ok := (*got).(*net.TCPListener); ok {
+		t.Fatalf("Takeover after inheritance returned a plain *net.TCPListener, TLS config was dropped")
+	}
+	if *got == net.Listener(raw) {
+		t.Fatalf("Takeover after inheritance returned the raw listener unwrapped, TLS config was dropped")
+	}
+}
+
+// TestTakeoverPlainListenerAfterInheritance确认不涉及TLS的老路径不受影响：
+// 继承到的裸TCP句柄原样返回，不会被意外包上TLS。
+func TestTakeoverPlainListenerAfterInheritance(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	defer raw.Close()
+
+	n := withSimulatedInheritance(t, raw)
+
+	got, err := n.Takeover(raw)
+	if err != nil {
+		t.Fatalf("Takeover: %v", err)
+	}
+	if *got != net.Listener(raw) {
+		t.Fatalf("Takeover without TLS config should return the inherited listener unchanged")
+	}
+}
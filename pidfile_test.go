@@ -0,0 +1,81 @@
+//go:build !windows
+
+package grace
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// TestAcquirePIDFileLockRejectsSecondHolder验证flock劝告锁确实跨文件描述符
+// 互斥：第二次在同一个pidfile路径上加锁必须失败，这是StartProcess用来检测
+// 双重fork的基础。
+func TestAcquirePIDFileLockRejectsSecondHolder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grace.pid")
+
+	first, err := acquirePIDFileLock(path)
+	if err != nil {
+		t.Fatalf("first acquirePIDFileLock: %v", err)
+	}
+	defer first.Close()
+
+	if _, err := acquirePIDFileLock(path); err == nil {
+		t.Fatal("second acquirePIDFileLock on a held lock should fail, got nil error")
+	}
+}
+
+// TestNetAcquirePIDLockIsExclusiveAcrossInstances验证两个各自持有PIDFile的
+// Net不能同时认为自己是"当前这一代"：第二个Net配置同一个PIDFile时，
+// acquirePIDLock必须失败，StartProcess据此拒绝发起这次重启。
+func TestNetAcquirePIDLockIsExclusiveAcrossInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "grace.pid")
+
+	owner := &Net{PIDFile: path}
+	if err := owner.acquirePIDLock(); err != nil {
+		t.Fatalf("owner.acquirePIDLock: %v", err)
+	}
+
+	challenger := &Net{PIDFile: path}
+	if err := challenger.acquirePIDLock(); err == nil {
+		t.Fatal("challenger.acquirePIDLock should fail while owner still holds the pid file lock")
+	}
+
+	if err := owner.Drain(); err != nil {
+		t.Fatalf("owner.Drain: %v", err)
+	}
+
+	// owner.Drain释放了锁，现在challenger应该能够拿到
+	if err := challenger.acquirePIDLock(); err != nil {
+		t.Fatalf("challenger.acquirePIDLock after owner released: %v", err)
+	}
+}
+
+// TestStartProcessRejectsConcurrentFork验证上一次StartProcess还没有被
+// Supervise确认就绪之前，第二次StartProcess必须直接拒绝，而不是真的再fork
+// 一个子进程出来跟前一个子进程抢同一组继承fd。这里直接把forking标记置1来
+// 模拟"已经有一次fork在途"，不需要真的发起一次fork。
+func TestStartProcessRejectsConcurrentFork(t *testing.T) {
+	n := &Net{}
+	if !atomic.CompareAndSwapInt32(&n.forking, 0, 1) {
+		t.Fatal("unexpected: forking flag already set on a fresh Net")
+	}
+
+	if _, err := n.StartProcess(); err == nil {
+		t.Fatal("StartProcess should refuse to run while a fork is already in progress")
+	}
+
+	// 拒绝发起新fork不应该清掉原来那次fork的守卫标记
+	if atomic.LoadInt32(&n.forking) != 1 {
+		t.Fatal("a rejected StartProcess call must not clear the in-flight fork guard")
+	}
+}
+
+// TestSuperviseWithoutPendingStartProcess验证没有对应的StartProcess调用时，
+// Supervise应该报错而不是panic或者误把当前监听句柄关掉。
+func TestSuperviseWithoutPendingStartProcess(t *testing.T) {
+	n := &Net{}
+	if err := n.Supervise(0); err == nil {
+		t.Fatal("Supervise without a pending StartProcess should return an error")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package grace
+
+import (
+	"os"
+	"syscall"
+)
+
+// acquirePIDFileLock在path上加一把进程独占的flock劝告锁，用来确认
+// 当前进程确实是"当前这一代"监听句柄的持有者：如果另一个进程已经持有这把锁
+// (比如一次异常的双重fork)，这里会直接返回错误而不是覆盖pid文件。
+// 返回的*os.File需要由调用方保持打开状态，锁会在它被Close(或进程退出)时释放。
+func acquirePIDFileLock(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package grace
+
+import "os"
+
+// acquirePIDFileLock是acquirePIDFileLock在windows上的退化实现。
+// windows没有POSIX的fcntl/flock语义，这里只是确保文件存在并可写，
+// 并不提供与unix版本等价的跨进程互斥保证。
+func acquirePIDFileLock(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+}
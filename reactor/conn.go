@@ -0,0 +1,24 @@
+package reactor
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// connSeq给每条连接分配一个递增的进程内唯一编号
+var connSeq int64
+
+// conn是基于标准库net.Conn的Conn实现，供fallback事件循环使用
+type conn struct {
+	id int64
+	nc net.Conn
+}
+
+func newConn(nc net.Conn) *conn {
+	return &conn{id: atomic.AddInt64(&connSeq, 1), nc: nc}
+}
+
+func (c *conn) ID() int                   { return int(c.id) }
+func (c *conn) Write(b []byte) (int, error) { return c.nc.Write(b) }
+func (c *conn) RemoteAddr() net.Addr      { return c.nc.RemoteAddr() }
+func (c *conn) Close() error              { return c.nc.Close() }
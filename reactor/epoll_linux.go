@@ -0,0 +1,159 @@
+//go:build linux
+
+package reactor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/vaiee/grace/refined"
+	"golang.org/x/sys/unix"
+)
+
+// epollLoop是Linux下的事件循环实现，每个CPU核心运行一个独立的epoll实例与
+// epoll_wait循环——每个实例都单独注册监听fd(EPOLLEXCLUSIVE语义由内核负责
+// 惊群抑制)，accept到的连接fd也只注册在accept它的那一个epoll实例上。这样
+// 任何一条连接的事件只可能投递给持有它的那个goroutine，poll内部的conns
+// map因此天然是goroutine私有的，不需要跨goroutine共享或加锁。
+type epollLoop struct {
+	lnFile  *os.File
+	lnFd    int
+	pool    *refined.Conn
+	handler Handler
+	bufSize int
+}
+
+func newEventLoop(ln net.Listener, opts Options, pool *refined.Conn, handler Handler) (eventLoop, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	f, ok := ln.(filer)
+	if !ok {
+		return nil, fmt.Errorf("reactor: listener %T does not expose a file descriptor", ln)
+	}
+	lnFile, err := f.File()
+	if err != nil {
+		return nil, err
+	}
+	lnFd := int(lnFile.Fd())
+	if err := unix.SetNonblock(lnFd, true); err != nil {
+		lnFile.Close()
+		return nil, err
+	}
+
+	return &epollLoop{
+		lnFile:  lnFile,
+		lnFd:    lnFd,
+		pool:    pool,
+		handler: handler,
+		bufSize: opts.ReadBufferSize,
+	}, nil
+}
+
+func (l *epollLoop) run() error {
+	defer l.lnFile.Close()
+
+	numLoops := runtime.NumCPU()
+	errCh := make(chan error, numLoops)
+	for i := 0; i < numLoops; i++ {
+		go l.poll(errCh)
+	}
+	return <-errCh
+}
+
+// poll是一个per-CPU的epoll_wait循环，每个goroutine拥有自己独立的epoll实例，
+// 监听fd以EPOLLEXCLUSIVE同时注册在所有实例上，accept到的连接fd只注册在
+// 当前实例上，因此conns只会被当前goroutine访问，不需要加锁。
+func (l *epollLoop) poll(errCh chan<- error) {
+	epfd, err := unix.EpollCreate1(0)
+	if err != nil {
+		errCh <- err
+		return
+	}
+	defer unix.Close(epfd)
+
+	lnEvent := unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLEXCLUSIVE, Fd: int32(l.lnFd)}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, l.lnFd, &lnEvent); err != nil {
+		errCh <- err
+		return
+	}
+
+	events := make([]unix.EpollEvent, 128)
+	conns := make(map[int32]*fdConn)
+	for {
+		n, err := unix.EpollWait(epfd, events, -1)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			errCh <- err
+			return
+		}
+		for i := 0; i < n; i++ {
+			ev := events[i]
+			if ev.Fd == int32(l.lnFd) {
+				l.accept(epfd, conns)
+				continue
+			}
+
+			c, ok := conns[ev.Fd]
+			if !ok {
+				continue
+			}
+			if ev.Events&(unix.EPOLLHUP|unix.EPOLLERR) != 0 {
+				l.closeConn(epfd, conns, c)
+				continue
+			}
+
+			l.readReady(epfd, conns, ev.Fd, c)
+		}
+	}
+}
+
+// readReady在边缘触发模式下把fd上当前可读的数据一次性读完：EPOLLET只在fd从
+// 不可读变为可读时投递一次事件，如果一次只读一个bufSize就返回，发送方在同一
+// 次写入里发出的、超过bufSize的剩余数据将永远不会再触发新的EPOLLIN，这条连接
+// 会悄无声息地卡死。因此这里必须循环读到EAGAIN/EWOULDBLOCK为止。
+func (l *epollLoop) readReady(epfd int, conns map[int32]*fdConn, fd int32, c *fdConn) {
+	for {
+		buf := make([]byte, l.bufSize)
+		nr, err := unix.Read(int(fd), buf)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				return
+			}
+			l.closeConn(epfd, conns, c)
+			return
+		}
+		if nr == 0 {
+			l.closeConn(epfd, conns, c)
+			return
+		}
+		dispatch(l.pool, c, buf[:nr], l.handler)
+	}
+}
+
+func (l *epollLoop) accept(epfd int, conns map[int32]*fdConn) {
+	for {
+		nfd, _, err := unix.Accept4(l.lnFd, unix.SOCK_NONBLOCK)
+		if err != nil {
+			return
+		}
+		// 边缘触发(EPOLLET)，配合非阻塞读，readReady会在每次EPOLLIN时循环读到
+		// EAGAIN为止，不依赖内核再发一次事件来通知剩余数据
+		event := unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLET, Fd: int32(nfd)}
+		if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, nfd, &event); err != nil {
+			unix.Close(nfd)
+			continue
+		}
+		conns[int32(nfd)] = newFdConn(nfd)
+	}
+}
+
+func (l *epollLoop) closeConn(epfd int, conns map[int32]*fdConn, c *fdConn) {
+	unix.EpollCtl(epfd, unix.EPOLL_CTL_DEL, c.fd, nil)
+	delete(conns, int32(c.fd))
+	c.Close()
+}
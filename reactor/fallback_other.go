@@ -0,0 +1,50 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package reactor
+
+import (
+	"net"
+
+	"github.com/vaiee/grace/refined"
+)
+
+// fallbackLoop在没有epoll/kqueue绑定的平台上(例如windows)退化为使用标准库的
+// netpoller：每条连接一个读goroutine，读到数据后仍然交给worker池处理，
+// 保证Handler侧的行为与epoll/kqueue实现一致。
+type fallbackLoop struct {
+	ln      net.Listener
+	pool    *refined.Conn
+	handler Handler
+	bufSize int
+}
+
+func newEventLoop(ln net.Listener, opts Options, pool *refined.Conn, handler Handler) (eventLoop, error) {
+	return &fallbackLoop{ln: ln, pool: pool, handler: handler, bufSize: opts.ReadBufferSize}, nil
+}
+
+func (l *fallbackLoop) run() error {
+	for {
+		nc, err := l.ln.Accept()
+		if err != nil {
+			return err
+		}
+		go l.readLoop(nc)
+	}
+}
+
+func (l *fallbackLoop) readLoop(nc net.Conn) {
+	c := newConn(nc)
+	defer nc.Close()
+	buf := make([]byte, l.bufSize)
+	for {
+		n, err := nc.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			dispatch(l.pool, c, data, l.handler)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
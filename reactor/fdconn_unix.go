@@ -0,0 +1,79 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package reactor
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// errFdConnClosed在fd已经被Close之后仍然尝试Write时返回
+var errFdConnClosed = errors.New("reactor: connection closed")
+
+// fdConn是epoll/kqueue事件循环下直接基于原始fd读写的Conn实现。它不经过
+// Go运行时的netpoller，读由事件循环自己的goroutine发起，但写由worker池的
+// goroutine异步发起——二者因此需要靠mutex互斥：Close必须等一个正在进行的
+// Write完成之后才能真正关闭fd，Write也必须在拿到fd之前确认fd还没被Close，
+// 否则close之后立刻被内核回收复用的fd号会被Write误写到一条无关的新连接上。
+type fdConn struct {
+	id int64
+
+	mu     sync.Mutex
+	fd     int
+	closed bool
+}
+
+func newFdConn(fd int) *fdConn {
+	return &fdConn{id: atomic.AddInt64(&connSeq, 1), fd: fd}
+}
+
+func (c *fdConn) ID() int { return int(c.id) }
+
+func (c *fdConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, errFdConnClosed
+	}
+	return unix.Write(c.fd, b)
+}
+
+func (c *fdConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	sa, err := unix.Getpeername(c.fd)
+	if err != nil {
+		return nil
+	}
+	return sockaddrToAddr(sa)
+}
+
+func (c *fdConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return unix.Close(c.fd)
+}
+
+func sockaddrToAddr(sa unix.Sockaddr) net.Addr {
+	switch v := sa.(type) {
+	case *unix.SockaddrInet4:
+		return &net.TCPAddr{IP: append([]byte(nil), v.Addr[:]...), Port: v.Port}
+	case *unix.SockaddrInet6:
+		return &net.TCPAddr{IP: append([]byte(nil), v.Addr[:]...), Port: v.Port}
+	case *unix.SockaddrUnix:
+		return &net.UnixAddr{Name: v.Name, Net: "unix"}
+	default:
+		return nil
+	}
+}
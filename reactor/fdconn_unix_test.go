@@ -0,0 +1,61 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package reactor
+
+import (
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestFdConnWriteAfterCloseDoesNotTouchFd验证Close之后的Write不会触碰
+// 底层fd(也就不会误写到内核回收复用之后的新连接上)，而是直接返回
+// errFdConnClosed。
+func TestFdConnWriteAfterCloseDoesNotTouchFd(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	defer unix.Close(fds[1])
+
+	c := newFdConn(fds[0])
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if _, err := c.Write([]byte("hi")); err != errFdConnClosed {
+		t.Fatalf("Write after Close: got err=%v, want errFdConnClosed", err)
+	}
+}
+
+// TestFdConnConcurrentWriteClose让Write与Close并发进行，重复多轮以放大
+// 互斥窗口，断言既不会panic也不会出现“写入已回收fd”的错误返回之外的情况。
+func TestFdConnConcurrentWriteClose(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatalf("socketpair: %v", err)
+		}
+
+		c := newFdConn(fds[0])
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.Write([]byte("x"))
+		}()
+		go func() {
+			defer wg.Done()
+			c.Close()
+		}()
+		wg.Wait()
+
+		// 无论Write和Close谁先谁后，Close完成之后fd都必须已经被关闭且
+		// 不会再被Write访问到。
+		if !c.closed {
+			t.Fatalf("round %d: fdConn not marked closed after Close", i)
+		}
+		unix.Close(fds[1])
+	}
+}
@@ -0,0 +1,162 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package reactor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/vaiee/grace/refined"
+	"golang.org/x/sys/unix"
+)
+
+// kqueueLoop是BSD/Darwin下的事件循环实现，每个CPU核心运行一个独立的kqueue
+// 实例与kevent循环——每个实例都单独注册监听fd，accept到的连接fd也只注册在
+// accept它的那一个kqueue实例上。监听fd上的可读事件会被所有实例同时唤醒
+// (kqueue没有EPOLLEXCLUSIVE等价物，accept本身是非阻塞的，唤醒多个goroutine
+// 抢accept不会有正确性问题，只是偶尔多做一次EAGAIN)，但一旦某个fd被accept，
+// 它只属于accept它的那个kqueue实例，conns因此天然是goroutine私有的。
+type kqueueLoop struct {
+	lnFile  *os.File
+	lnFd    int
+	pool    *refined.Conn
+	handler Handler
+	bufSize int
+}
+
+func newEventLoop(ln net.Listener, opts Options, pool *refined.Conn, handler Handler) (eventLoop, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	f, ok := ln.(filer)
+	if !ok {
+		return nil, fmt.Errorf("reactor: listener %T does not expose a file descriptor", ln)
+	}
+	lnFile, err := f.File()
+	if err != nil {
+		return nil, err
+	}
+	lnFd := int(lnFile.Fd())
+	if err := unix.SetNonblock(lnFd, true); err != nil {
+		lnFile.Close()
+		return nil, err
+	}
+
+	return &kqueueLoop{
+		lnFile:  lnFile,
+		lnFd:    lnFd,
+		pool:    pool,
+		handler: handler,
+		bufSize: opts.ReadBufferSize,
+	}, nil
+}
+
+func (l *kqueueLoop) run() error {
+	defer l.lnFile.Close()
+
+	numLoops := runtime.NumCPU()
+	errCh := make(chan error, numLoops)
+	for i := 0; i < numLoops; i++ {
+		go l.poll(errCh)
+	}
+	return <-errCh
+}
+
+func (l *kqueueLoop) poll(errCh chan<- error) {
+	kq, err := unix.Kqueue()
+	if err != nil {
+		errCh <- err
+		return
+	}
+	defer unix.Close(kq)
+
+	lnChange := []unix.Kevent_t{{Ident: uint64(l.lnFd), Filter: unix.EVFILT_READ, Flags: unix.EV_ADD}}
+	if _, err := unix.Kevent(kq, lnChange, nil, nil); err != nil {
+		errCh <- err
+		return
+	}
+
+	events := make([]unix.Kevent_t, 128)
+	conns := make(map[int]*fdConn)
+	for {
+		n, err := unix.Kevent(kq, nil, events, nil)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			errCh <- err
+			return
+		}
+		for i := 0; i < n; i++ {
+			ev := events[i]
+			fd := int(ev.Ident)
+			if fd == l.lnFd {
+				l.accept(kq, conns)
+				continue
+			}
+
+			c, ok := conns[fd]
+			if !ok {
+				continue
+			}
+			if ev.Flags&unix.EV_EOF != 0 {
+				l.closeConn(kq, conns, c)
+				continue
+			}
+
+			l.readReady(kq, conns, fd, c)
+		}
+	}
+}
+
+// readReady在边缘触发(EV_CLEAR)模式下把fd上当前可读的数据一次性读完：
+// EV_CLEAR只在fd从不可读变为可读时投递一次事件，如果一次只读一个bufSize就
+// 返回，发送方在同一次写入里发出的、超过bufSize的剩余数据将永远不会再触发
+// 新事件，这条连接会悄无声息地卡死。因此这里必须循环读到EAGAIN/EWOULDBLOCK
+// 为止。
+func (l *kqueueLoop) readReady(kq int, conns map[int]*fdConn, fd int, c *fdConn) {
+	for {
+		buf := make([]byte, l.bufSize)
+		nr, err := unix.Read(fd, buf)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+				return
+			}
+			l.closeConn(kq, conns, c)
+			return
+		}
+		if nr == 0 {
+			l.closeConn(kq, conns, c)
+			return
+		}
+		dispatch(l.pool, c, buf[:nr], l.handler)
+	}
+}
+
+func (l *kqueueLoop) accept(kq int, conns map[int]*fdConn) {
+	for {
+		nfd, _, err := unix.Accept(l.lnFd)
+		if err != nil {
+			return
+		}
+		if err := unix.SetNonblock(nfd, true); err != nil {
+			unix.Close(nfd)
+			continue
+		}
+		changes := []unix.Kevent_t{{Ident: uint64(nfd), Filter: unix.EVFILT_READ, Flags: unix.EV_ADD | unix.EV_CLEAR}}
+		if _, err := unix.Kevent(kq, changes, nil, nil); err != nil {
+			unix.Close(nfd)
+			continue
+		}
+		conns[nfd] = newFdConn(nfd)
+	}
+}
+
+func (l *kqueueLoop) closeConn(kq int, conns map[int]*fdConn, c *fdConn) {
+	changes := []unix.Kevent_t{{Ident: uint64(c.fd), Filter: unix.EVFILT_READ, Flags: unix.EV_DELETE}}
+	unix.Kevent(kq, changes, nil, nil)
+	delete(conns, c.fd)
+	c.Close()
+}
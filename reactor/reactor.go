@@ -0,0 +1,77 @@
+// Package reactor提供一个基于epoll(Linux)/kqueue(BSD/Darwin)的、
+// goroutine池驱动的TCP服务，用于替代每连接一个goroutine的传统模型，
+// 缓解C10K场景下的调度与内存开销(参考gnet/evio的reactor模式)。
+//
+// Serve接管的listener通常来自grace.Net.Takeover，这样底层fd在
+// fork+exec重启时也能被新进程重新接管，事件循环随进程一起平滑重建。
+package reactor
+
+import (
+	"net"
+	"runtime"
+)
+
+// Conn代表reactor接管的一条客户端连接，供Handler读写。
+type Conn interface {
+	// ID是这条连接在当前进程内的唯一编号，可用于日志关联
+	ID() int
+	Write(b []byte) (int, error)
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// Handler处理一次从客户端读取到的数据，返回值会被写回客户端；
+// 返回nil表示这次不需要回复。Handler通常在worker池的goroutine中被调用，
+// worker池耗尽或已关闭时则在事件循环的goroutine中同步调用；
+// 不要在其中执行长时间阻塞的操作，否则会顶住整个worker乃至事件循环。
+type Handler func(c Conn, data []byte) []byte
+
+// Options控制Serve的行为，零值表示使用默认配置。
+type Options struct {
+	// Workers是常驻worker goroutine的数量，默认为runtime.NumCPU()
+	Workers int
+	// ReadBufferSize是每次从客户端fd读取数据使用的缓冲区大小，默认4096
+	ReadBufferSize int
+}
+
+func (o Options) withDefaults() Options {
+	if o.Workers <= 0 {
+		o.Workers = runtime.NumCPU()
+	}
+	if o.ReadBufferSize <= 0 {
+		o.ReadBufferSize = 4096
+	}
+	return o
+}
+
+// eventLoop是各平台(epoll/kqueue/fallback)事件循环的统一入口，
+// 具体实现由newEventLoop按build tag选择。
+type eventLoop interface {
+	run() error
+}
+
+// Serve使用默认Options驱动ln上的事件，详见ServeOptions。
+func Serve(ln net.Listener, handler Handler) error {
+	return ServeOptions(ln, handler, Options{})
+}
+
+// ServeOptions在ln上建立事件循环并持续处理连接，直到发生不可恢复的错误。
+// 每个到达的事件交给常驻worker池中的空闲goroutine处理，而不是为每个事件
+// 新建goroutine；worker池耗尽或已关闭时，事件在事件循环自己的goroutine里
+// 同步处理。epoll/kqueue实现不为每条连接新建goroutine，fallback实现为每条
+// 连接起一个读goroutine。
+func ServeOptions(ln net.Listener, handler Handler, opts Options) error {
+	opts = opts.withDefaults()
+
+	pool, err := newWorkerPool(opts.Workers)
+	if err != nil {
+		return err
+	}
+	defer pool.Release()
+
+	loop, err := newEventLoop(ln, opts, pool, handler)
+	if err != nil {
+		return err
+	}
+	return loop.run()
+}
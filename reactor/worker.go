@@ -0,0 +1,92 @@
+package reactor
+
+import (
+	"context"
+
+	"github.com/vaiee/grace/refined"
+)
+
+// job是投递给worker的一次待处理事件
+type job struct {
+	conn    Conn
+	data    []byte
+	handler Handler
+}
+
+// worker是被refined.Conn复用的常驻goroutine。事件循环不会为每个事件新建
+// goroutine，而是从池里Acquire一个空闲worker把job喂给它，worker处理完
+// 后自行Regain回池中，从而让goroutine被反复复用。
+type worker struct {
+	// poolRef指向newWorkerPool里的pool变量。worker在builder里构造时，
+	// 外层的*refined.Conn还没有赋值，所以这里存的是变量地址而不是值本身，
+	// 真正取值放到第一次Regain时，那时pool早已经构造完成。
+	poolRef *(*refined.Conn)
+	jobs    chan job
+	done    chan struct{}
+}
+
+func (w *worker) loop() {
+	for {
+		select {
+		case j := <-w.jobs:
+			if resp := j.handler(j.conn, j.data); resp != nil {
+				_, _ = j.conn.Write(resp)
+			}
+			_ = (*w.poolRef).Regain(w)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Close实现refined.Poolable，池关闭时调用，结束这个worker的loop
+func (w *worker) Close() error {
+	close(w.done)
+	return nil
+}
+
+// Done实现refined.Poolable；worker只有在被显式Close时才算"已失效"
+func (w *worker) Done() <-chan struct{} {
+	return w.done
+}
+
+// newWorkerPool创建一个容量为size的worker池。由于refined.NewConnManager会在
+// 构造期间同步调用builder size次，而worker自身又需要持有池的引用用于Regain，
+// 这里先声明pool变量再在builder闭包里引用它——实际调用只会发生在
+// NewConnManager返回、pool被赋值之后，所以不存在数据竞争。
+func newWorkerPool(size int) (*refined.Conn, error) {
+	var pool *refined.Conn
+	builder := func() (refined.Poolable, error) {
+		w := &worker{poolRef: &pool, jobs: make(chan job, 1), done: make(chan struct{})}
+		go w.loop()
+		return w, nil
+	}
+	p, err := refined.NewConnManager(size, builder)
+	if err != nil {
+		return nil, err
+	}
+	pool = p
+	return p, nil
+}
+
+// dispatch从pool中取一个空闲worker处理本次事件；如果池已关闭，或者所有
+// worker都在忙(池已耗尽)，直接在当前goroutine同步处理，保证事件不丢失。
+// dispatch是被epoll/kqueue每个实例的poll()同步调用的，池子耗尽时绝不能
+// 像普通的pool.Acquire()那样无限期阻塞等待worker释放——那样会顶住整个
+// poll()所在的epoll/kqueue实例，这个CPU上所有连接的accept/read都会停摆，
+// 直到某个worker碰巧空出来为止。这里改用一个已经被取消的context调用
+// AcquireContext，只做一次非阻塞尝试：池子关闭时立刻拿到PoolClosed，
+// 耗尽时立刻拿到ctx.Err()，都不会阻塞。
+func dispatch(pool *refined.Conn, c Conn, data []byte, handler Handler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p, err := pool.AcquireContext(ctx)
+	if err != nil {
+		if resp := handler(c, data); resp != nil {
+			_, _ = c.Write(resp)
+		}
+		return
+	}
+	w := p.(*worker)
+	w.jobs <- job{conn: c, data: data, handler: handler}
+}
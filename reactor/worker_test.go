@@ -0,0 +1,112 @@
+package reactor
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn是一个最小的Conn实现，只用来观察Handler/Write被调用的次数
+type fakeConn struct {
+	id      int
+	written [][]byte
+	mu      sync.Mutex
+}
+
+func (c *fakeConn) ID() int { return c.id }
+func (c *fakeConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written = append(c.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+func (c *fakeConn) RemoteAddr() net.Addr { return nil }
+func (c *fakeConn) Close() error         { return nil }
+
+func (c *fakeConn) writes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.written)
+}
+
+func TestDispatchReusesWorkers(t *testing.T) {
+	pool, err := newWorkerPool(2)
+	if err != nil {
+		t.Fatalf("newWorkerPool: %v", err)
+	}
+	defer pool.Release()
+
+	echo := func(c Conn, data []byte) []byte { return data }
+
+	const n = 20
+	conns := make([]*fakeConn, n)
+	for i := 0; i < n; i++ {
+		conns[i] = &fakeConn{id: i}
+		dispatch(pool, conns[i], []byte("ping"), echo)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for _, c := range conns {
+		for c.writes() == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if c.writes() != 1 {
+			t.Fatalf("conn %d: want 1 write, got %d", c.id, c.writes())
+		}
+	}
+}
+
+// TestDispatchFallsBackWhenPoolExhausted验证dispatch在所有worker都忙的时候
+// (池未关闭，只是耗尽)同样会退化为同步处理，而不是像普通的pool.Acquire()
+// 那样无限期阻塞——dispatch是被epoll/kqueue的poll()同步调用的，阻塞在这里
+// 会顶住整个事件循环，这个CPU上所有连接都会停摆。
+func TestDispatchFallsBackWhenPoolExhausted(t *testing.T) {
+	pool, err := newWorkerPool(1)
+	if err != nil {
+		t.Fatalf("newWorkerPool: %v", err)
+	}
+	defer pool.Release()
+
+	gate := make(chan struct{})
+	defer close(gate)
+	block := func(c Conn, data []byte) []byte {
+		<-gate
+		return data
+	}
+	// 占用唯一的worker，它会卡在handler里直到gate被放行，池子在此期间耗尽
+	dispatch(pool, &fakeConn{id: 1}, []byte("ping"), block)
+
+	echo := func(c Conn, data []byte) []byte { return data }
+	idle := &fakeConn{id: 2}
+	done := make(chan struct{})
+	go func() {
+		dispatch(pool, idle, []byte("ping"), echo)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch blocked instead of falling back synchronously when the pool was exhausted")
+	}
+	if idle.writes() != 1 {
+		t.Fatalf("want 1 write via synchronous fallback, got %d", idle.writes())
+	}
+}
+
+func TestDispatchFallsBackWhenPoolClosed(t *testing.T) {
+	pool, err := newWorkerPool(1)
+	if err != nil {
+		t.Fatalf("newWorkerPool: %v", err)
+	}
+	pool.Release()
+
+	echo := func(c Conn, data []byte) []byte { return data }
+	c := &fakeConn{id: 1}
+	// 池已关闭，dispatch应当退化为同步处理而不是panic或丢事件
+	dispatch(pool, c, []byte("ping"), echo)
+	if c.writes() != 1 {
+		t.Fatalf("want 1 write via synchronous fallback, got %d", c.writes())
+	}
+}
@@ -0,0 +1,359 @@
+package refined
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	PoolClosed    = errors.New("conn pool is closed")
+	InvalidConfig = errors.New("invalid config")
+)
+
+type Poolable interface {
+	io.Closer
+	Done() <-chan struct{}
+}
+
+type builder func() (Poolable, error)
+
+// Validator在Acquire/AcquireContext取出对象时执行一次，返回非nil错误表示
+// 该对象已经不可用(例如连接已经被对端关闭但Done()还没有感知到)，此时池
+// 会丢弃它并按需重建一个新的，而不是把一个半开的对象交给调用方。
+type Validator func(Poolable) error
+
+// entry在对象本身之外附带池管理需要的时间信息
+type entry struct {
+	obj       Poolable
+	createdAt time.Time
+	idleAt    time.Time
+}
+
+// Options配置对象池的校验与过期策略，零值表示不做额外校验、对象永不过期
+type Options struct {
+	// Validator见同名类型注释
+	Validator Validator
+	// MaxIdle是对象被归还后允许保持空闲的最长时间，超过会被reaper关闭重建；
+	// 0表示不限制
+	MaxIdle time.Duration
+	// MaxLifetime是对象从创建起允许存活的最长时间，超过会被reaper关闭重建；
+	// 0表示不限制
+	MaxLifetime time.Duration
+}
+
+type Conn struct {
+	pool    chan *entry   // 可关闭对象池
+	max     int           // 池容量
+	active  int           // 可用的对象数
+	closed  bool          // 池是否已关闭
+	builder builder       // 构造对象
+	mutex   *sync.Mutex
+	event   chan struct{} // 关闭对象之后通知排队者有对象可用
+
+	validator   Validator
+	maxIdle     time.Duration
+	maxLifetime time.Duration
+	created     map[Poolable]time.Time // 记录每个对象的创建时间，用于MaxLifetime判断
+	reaperStop  chan struct{}
+}
+
+// 获取对象，等价于AcquireContext(context.Background())
+func (conn *Conn) Acquire() (Poolable, error) {
+	return conn.AcquireContext(context.Background())
+}
+
+// AcquireContext获取对象，在等待池中出现可用对象期间会响应ctx的取消，
+// 避免像旧版Acquire那样在池耗尽时无法被中断地一直阻塞下去。
+// 取出的对象如果Done()已经触发，或者配置了Validator且校验失败，会被丢弃，
+// 并继续尝试获取下一个(期间会按需重建新对象)。
+func (conn *Conn) AcquireContext(ctx context.Context) (Poolable, error) {
+	for {
+		e, err := conn.acquireContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-e.obj.Done():
+			conn.discard(e)
+			continue
+		default:
+		}
+
+		if conn.validator != nil {
+			if err := conn.validator(e.obj); err != nil {
+				conn.discard(e)
+				continue
+			}
+		}
+
+		return e.obj, nil
+	}
+}
+
+func (conn *Conn) acquireContext(ctx context.Context) (*entry, error) {
+	for {
+		select {
+		case e, ok := <-conn.pool:
+			if !ok {
+				return nil, PoolClosed
+			}
+			return e, nil
+		default:
+		}
+
+		conn.mutex.Lock()
+		if conn.closed {
+			conn.mutex.Unlock()
+			return nil, PoolClosed
+		}
+		if conn.active >= conn.max {
+			waitCh := conn.event
+			conn.mutex.Unlock()
+			select {
+			case e, ok := <-conn.pool:
+				if !ok {
+					return nil, PoolClosed
+				}
+				return e, nil
+			case <-waitCh:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		obj, err := conn.builder()
+		if err != nil {
+			conn.mutex.Unlock()
+			return nil, err
+		}
+		conn.active++
+		now := time.Now()
+		conn.created[obj] = now
+		conn.mutex.Unlock()
+		return &entry{obj: obj, createdAt: now, idleAt: now}, nil
+	}
+}
+
+// 回收对象
+func (conn *Conn) Regain(closer Poolable) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	// Release关闭conn.pool之后不能再往里面写，否则会panic；
+	// 这里必须在持有mutex的前提下重新确认closed，不能信赖调用前的状态
+	if conn.closed {
+		return PoolClosed
+	}
+	createdAt, ok := conn.created[closer]
+	if !ok {
+		createdAt = time.Now()
+		conn.created[closer] = createdAt
+	}
+	conn.pool <- &entry{obj: closer, createdAt: createdAt, idleAt: time.Now()}
+	return nil
+}
+
+// 关闭对象，不再归还给对象池
+func (conn *Conn) Close(closer Poolable) error {
+	conn.mutex.Lock()
+	err := closer.Close()
+	if err != nil {
+		conn.mutex.Unlock()
+		return err
+	}
+	delete(conn.created, closer)
+	conn.active--
+	conn.mutex.Unlock()
+	conn.signal()
+	return nil
+}
+
+// discard关闭一个被判定为已失效的对象(Done()已触发或Validator校验失败)，
+// 并唤醒可能正在等待对象可用的Acquire/AcquireContext调用
+func (conn *Conn) discard(e *entry) {
+	conn.mutex.Lock()
+	e.obj.Close()
+	delete(conn.created, e.obj)
+	conn.active--
+	conn.mutex.Unlock()
+	conn.signal()
+}
+
+// signal唤醒所有正阻塞在acquireContext里等待active<max的调用者。这里用
+// "关闭旧channel再换上一个新的"来广播，而不是像早期版本那样往conn.event里
+// 发一个值：非阻塞发送在没人接收时会被直接丢弃，如果signal发生在等待者
+// mutex.Unlock()之后、select还没真正执行到的这段间隙(正常的调度延迟，
+// GC或抢占都可能造成)，那次唤醒就永久丢失了，等待者会卡死在
+// AcquireContext里，即便active<max本该能立刻满足它。而关闭一个channel
+// 对所有后来才开始等待它的接收者同样可见，不存在"来晚了就收不到"的问题；
+// 等待者在acquireContext里总是在持有mutex时捕获当前的conn.event，
+// 与这里替换conn.event互斥，因此不会捕获到一个已经被关闭、且替换发生在
+// 捕获之前的旧channel却误以为它还没关闭。
+func (conn *Conn) signal() {
+	conn.mutex.Lock()
+	close(conn.event)
+	conn.event = make(chan struct{})
+	conn.mutex.Unlock()
+}
+
+// 关闭对象池
+func (conn *Conn) Release() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.closed {
+		return PoolClosed
+	}
+	close(conn.pool)
+	for e := range conn.pool {
+		conn.active--
+		delete(conn.created, e.obj)
+		e.obj.Close()
+	}
+	conn.closed = true
+	close(conn.reaperStop)
+	return nil
+}
+
+// 创建对象管理器
+func NewConnManager(max int, builder builder) (*Conn, error) {
+	return NewConnManagerWithOptions(max, builder, Options{})
+}
+
+// NewConnManagerWithOptions创建对象管理器，并附带校验与过期策略，
+// 详见Options
+func NewConnManagerWithOptions(max int, builder builder, opts Options) (*Conn, error) {
+	if max <= 0 {
+		return nil, InvalidConfig
+	}
+	conn := &Conn{
+		max:         max,
+		pool:        make(chan *entry, max),
+		closed:      false,
+		builder:     builder,
+		mutex:       new(sync.Mutex),
+		event:       make(chan struct{}),
+		validator:   opts.Validator,
+		maxIdle:     opts.MaxIdle,
+		maxLifetime: opts.MaxLifetime,
+		created:     make(map[Poolable]time.Time, max),
+		reaperStop:  make(chan struct{}),
+	}
+	for i := 0; i < max; i++ {
+		closer, err := builder()
+		if err != nil {
+			return nil, err
+		}
+		conn.active++
+		now := time.Now()
+		conn.created[closer] = now
+		conn.pool <- &entry{obj: closer, createdAt: now, idleAt: now}
+	}
+	if conn.maxIdle > 0 || conn.maxLifetime > 0 {
+		go conn.reap()
+	}
+	return conn, nil
+}
+
+// reap定期扫描池中处于空闲状态的对象，关闭并重建超过MaxIdle/MaxLifetime的对象
+func (conn *Conn) reap() {
+	interval := conn.maxIdle
+	if interval <= 0 || (conn.maxLifetime > 0 && conn.maxLifetime < interval) {
+		interval = conn.maxLifetime
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			conn.reapOnce()
+		case <-conn.reaperStop:
+			return
+		}
+	}
+}
+
+func (conn *Conn) reapOnce() {
+	now := time.Now()
+	for _, e := range conn.drainIdle() {
+		if (conn.maxIdle > 0 && now.Sub(e.idleAt) > conn.maxIdle) ||
+			(conn.maxLifetime > 0 && now.Sub(e.createdAt) > conn.maxLifetime) {
+			conn.discardAndRebuild(e)
+			continue
+		}
+		// 未过期的对象原样放回池中，保留原来的idleAt，空闲计时不因扫描而重新开始
+		conn.mutex.Lock()
+		if conn.closed {
+			conn.mutex.Unlock()
+			// 池已经在扫描期间被Release，直接关闭剩余对象即可
+			e.obj.Close()
+			continue
+		}
+		conn.pool <- e
+		conn.mutex.Unlock()
+	}
+}
+
+// drainIdle把当前池里所有空闲对象一次性取出来，不阻塞等待正在被占用的对象
+func (conn *Conn) drainIdle() []*entry {
+	var entries []*entry
+	for {
+		select {
+		case e, ok := <-conn.pool:
+			if !ok {
+				return entries
+			}
+			entries = append(entries, e)
+		default:
+			return entries
+		}
+	}
+}
+
+// discardAndRebuild关闭一个过期对象，并重建一个新的放回池中以维持池容量。
+// active在重建过程中自始至终保持不变：这个槽位只是暂时从旧对象换成新对象，
+// 并没有真正"空出来"过，所以不会让并发的Acquire/AcquireContext误以为
+// active<max进而多建一个对象——那样会打破"conn.pool的容量(max)永远能装得下
+// 未被借出的active个对象"这个不变量，一旦打破，Regain/discardAndRebuild往
+// conn.pool的发送就可能在持有mutex的情况下阻塞，把整个池子锁死(曾经在
+// builder阻塞期间被并发Acquire抢建过一次新对象就是这么复现的)。只有重建
+// 失败、或者扫描期间池子被Release了，这个槽位才算真的没了，这时才真正把
+// active减一，并唤醒可能正在等待active<max的调用者。
+func (conn *Conn) discardAndRebuild(e *entry) {
+	conn.mutex.Lock()
+	e.obj.Close()
+	delete(conn.created, e.obj)
+	if conn.closed {
+		conn.active--
+		conn.mutex.Unlock()
+		return
+	}
+	conn.mutex.Unlock()
+
+	obj, err := conn.builder()
+
+	conn.mutex.Lock()
+	if conn.closed {
+		conn.active--
+		conn.mutex.Unlock()
+		if err == nil {
+			obj.Close()
+		}
+		return
+	}
+	if err != nil {
+		// 重建失败，这个槽位真的没了，后续Acquire在active<max时会按需补上
+		conn.active--
+		conn.mutex.Unlock()
+		conn.signal()
+		return
+	}
+	now := time.Now()
+	conn.created[obj] = now
+	conn.pool <- &entry{obj: obj, createdAt: now, idleAt: now}
+	conn.mutex.Unlock()
+}
@@ -0,0 +1,332 @@
+package refined
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakePoolable是一个最小的Poolable实现，Done()永远不会触发，
+// 只用来驱动Conn的计数与等待逻辑，不携带真实资源。
+type fakePoolable struct {
+	done chan struct{}
+}
+
+func (f *fakePoolable) Close() error          { return nil }
+func (f *fakePoolable) Done() <-chan struct{} { return f.done }
+
+// trackedPoolable在fakePoolable基础上记录自己是否被Close过，并带有一个
+// 递增的id，用来在Validator/reaper相关的测试里区分"哪个对象被丢弃重建了"。
+type trackedPoolable struct {
+	fakePoolable
+	id     int
+	closed int32
+}
+
+func (t *trackedPoolable) Close() error {
+	atomic.StoreInt32(&t.closed, 1)
+	return t.fakePoolable.Close()
+}
+
+func (t *trackedPoolable) wasClosed() bool {
+	return atomic.LoadInt32(&t.closed) == 1
+}
+
+// trackedBuilder返回一个builder，每次调用都构造一个新的trackedPoolable并
+// 记录下来，供测试断言具体是哪个实例被丢弃、哪个被交给了调用方。
+func trackedBuilder() (func() (Poolable, error), func() []*trackedPoolable) {
+	var mu sync.Mutex
+	var created []*trackedPoolable
+	builder := func() (Poolable, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		tp := &trackedPoolable{fakePoolable: fakePoolable{done: make(chan struct{})}, id: len(created) + 1}
+		created = append(created, tp)
+		return tp, nil
+	}
+	snapshot := func() []*trackedPoolable {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*trackedPoolable(nil), created...)
+	}
+	return builder, snapshot
+}
+
+// TestSignalDoesNotMissWaiterThatAlreadyCapturedEvent重现signal()曾经存在
+// 的丢失唤醒问题：acquireContext在持有mutex期间读出当前的conn.event，
+// 解锁之后才真正进入select等待它。如果这段解锁到进入select之间发生了
+// 调度延迟(GC、抢占、或仅仅是正常的goroutine切换)，使得Close/discard在
+// 这期间调用了旧版signal()——一次尽力而为的非阻塞发送——那次通知就会
+// 因为没人在接收而被直接丢弃，等待者将永远等不到它。
+//
+// 这里不依赖真实的调度窗口(那种竞争很难在测试里稳定复现)，而是直接按
+// acquireContext的方式手动捕获一次conn.event，再触发一次signal，断言
+// 已经捕获到的那个channel确实被关闭、唤醒了等待它的goroutine。
+func TestSignalDoesNotMissWaiterThatAlreadyCapturedEvent(t *testing.T) {
+	pool, err := NewConnManager(1, func() (Poolable, error) {
+		return &fakePoolable{done: make(chan struct{})}, nil
+	})
+	if err != nil {
+		t.Fatalf("NewConnManager: %v", err)
+	}
+	defer pool.Release()
+
+	obj, err := pool.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	// 模拟acquireContext里"池子已跑满、捕获conn.event之后"的那一刻，
+	// 此时调用方还没有进入select，但已经持有了将要等待的那个channel
+	pool.mutex.Lock()
+	waitCh := pool.event
+	pool.mutex.Unlock()
+
+	if err := pool.Close(obj); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	select {
+	case <-waitCh:
+	case <-time.After(time.Second):
+		t.Fatal("waiter holding the pre-signal event channel was never woken up (lost wakeup)")
+	}
+}
+
+// TestDiscardAndRebuildDoesNotOvercommitActive重现discardAndRebuild曾经
+// 存在的"Regain race"：它在调用builder()重建替换对象之前就先把active减一、
+// 之后才重新加回去，这段窗口期间一个并发的AcquireContext会看到active<max，
+// 误以为池子没跑满，多建一个本不该存在的对象——active就超出了max，而
+// conn.pool的容量始终是max，后续任何一次往里面送entry的操作(Regain或
+// discardAndRebuild自己)都可能在持有mutex的情况下阻塞，把整个池子锁死。
+// 这里用一个在rebuild期间卡住不返回的builder，验证active在整个重建过程中
+// 自始至终等于max，并发的AcquireContext必须老老实实等待(或者像这里一样
+// 等到ctx超时)，而不是趁机多建一个。
+func TestDiscardAndRebuildDoesNotOvercommitActive(t *testing.T) {
+	buildGate := make(chan struct{})
+	var buildCount int32
+
+	pool, err := NewConnManagerWithOptions(1, func() (Poolable, error) {
+		if atomic.AddInt32(&buildCount, 1) == 2 {
+			<-buildGate // 卡住第二次构建(重建那一次)，直到测试放行
+		}
+		return &fakePoolable{done: make(chan struct{})}, nil
+	}, Options{})
+	if err != nil {
+		t.Fatalf("NewConnManagerWithOptions: %v", err)
+	}
+	defer pool.Release()
+
+	// 直接取出构造期间放进去的那个entry，模拟reapOnce.drainIdle()的效果，
+	// 然后在后台触发discardAndRebuild，此时它会卡在builder()里出不来
+	e := <-pool.pool
+	rebuildDone := make(chan struct{})
+	go func() {
+		pool.discardAndRebuild(e)
+		close(rebuildDone)
+	}()
+
+	// 等discardAndRebuild真正跑到卡住builder()的那一步
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&buildCount) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&buildCount) < 2 {
+		t.Fatal("discardAndRebuild never called builder() for the replacement object")
+	}
+
+	acquireErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, err := pool.AcquireContext(ctx)
+		acquireErr <- err
+	}()
+
+	select {
+	case err := <-acquireErr:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("pool should still look exhausted (active==max) while the rebuild is in flight, got err=%v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("AcquireContext neither returned nor timed out while the rebuild was in flight")
+	}
+
+	close(buildGate)
+	select {
+	case <-rebuildDone:
+	case <-time.After(time.Second):
+		t.Fatal("discardAndRebuild did not finish after builder() was unblocked")
+	}
+
+	// 重建完成之后池子必须是健康的，不能被卡在之前某次持锁发送上
+	done := make(chan error, 1)
+	go func() {
+		obj, err := pool.Acquire()
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- pool.Regain(obj)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("pool is wedged after discardAndRebuild: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pool is wedged after discardAndRebuild: Acquire/Regain never returned")
+	}
+}
+
+// TestAcquireContextUnblocksAfterConcurrentClose是
+// TestSignalDoesNotMissWaiterThatAlreadyCapturedEvent的端到端版本：一个Acquire在池跑满时阻塞，另一个goroutine并发Close掉已取出的对象，
+// 阻塞的一方必须能在合理时间内拿到对象，而不是永远卡住。
+func TestAcquireContextUnblocksAfterConcurrentClose(t *testing.T) {
+	pool, err := NewConnManager(1, func() (Poolable, error) {
+		return &fakePoolable{done: make(chan struct{})}, nil
+	})
+	if err != nil {
+		t.Fatalf("NewConnManager: %v", err)
+	}
+	defer pool.Release()
+
+	obj, err := pool.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := pool.Acquire()
+		result <- err
+	}()
+
+	if err := pool.Close(obj); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Acquire blocked forever after a concurrent Close")
+	}
+}
+
+// TestAcquireContextDiscardsObjectFailingValidator验证Validator校验失败的
+// 对象会被丢弃并重建，而不是交给调用方——即便它的Done()还没有触发。
+func TestAcquireContextDiscardsObjectFailingValidator(t *testing.T) {
+	errStale := errors.New("half-open")
+	builder, created := trackedBuilder()
+
+	var staleID int32 = 1 // 构造期间建好的第一个对象(id==1)判定为"半开"
+	validator := func(p Poolable) error {
+		if p.(*trackedPoolable).id == int(atomic.LoadInt32(&staleID)) {
+			return errStale
+		}
+		return nil
+	}
+
+	pool, err := NewConnManagerWithOptions(1, builder, Options{Validator: validator})
+	if err != nil {
+		t.Fatalf("NewConnManagerWithOptions: %v", err)
+	}
+	defer pool.Release()
+
+	got, err := pool.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	tp := got.(*trackedPoolable)
+	if tp.id == 1 {
+		t.Fatalf("Validator should have discarded object #1, but it was returned to the caller")
+	}
+
+	all := created()
+	if len(all) != 2 {
+		t.Fatalf("want 2 objects built (1 discarded + 1 replacement), got %d", len(all))
+	}
+	if !all[0].wasClosed() {
+		t.Fatal("object #1 failed validation and should have been closed")
+	}
+}
+
+// TestReapClosesAndRebuildsExpiredIdleObjects验证MaxIdle到期的空闲对象会被
+// reaper关闭并用一个新对象替换，保持池容量不变。
+func TestReapClosesAndRebuildsExpiredIdleObjects(t *testing.T) {
+	builder, created := trackedBuilder()
+
+	pool, err := NewConnManagerWithOptions(1, builder, Options{MaxIdle: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewConnManagerWithOptions: %v", err)
+	}
+	defer pool.Release()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(created()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	all := created()
+	if len(all) < 2 {
+		t.Fatalf("want the reaper to have rebuilt the idle object at least once, got %d objects built", len(all))
+	}
+	if !all[0].wasClosed() {
+		t.Fatal("the original idle object should have been closed once MaxIdle elapsed")
+	}
+
+	// 池容量不应该因为reap而变化：还是能正常借出一个对象
+	obj, err := pool.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire after reap: %v", err)
+	}
+	if err := pool.Regain(obj); err != nil {
+		t.Fatalf("Regain after reap: %v", err)
+	}
+}
+
+// TestAcquireContextReturnsCtxErrOnCancel验证池子跑满时阻塞在AcquireContext
+// 里的调用会在ctx被取消后立刻返回ctx.Err()，而不是继续等下去。
+func TestAcquireContextReturnsCtxErrOnCancel(t *testing.T) {
+	pool, err := NewConnManager(1, func() (Poolable, error) {
+		return &fakePoolable{done: make(chan struct{})}, nil
+	})
+	if err != nil {
+		t.Fatalf("NewConnManager: %v", err)
+	}
+	defer pool.Release()
+
+	obj, err := pool.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer pool.Close(obj)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		_, err := pool.AcquireContext(ctx)
+		result <- err
+	}()
+
+	// 等后台的AcquireContext真正进入阻塞态再取消，避免在它还没来得及
+	// 等待之前就被取消，那样测不出ctx.Done()真的解除了阻塞
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Fatalf("want context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("AcquireContext did not return after its context was canceled")
+	}
+}